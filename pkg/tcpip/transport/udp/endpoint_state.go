@@ -0,0 +1,100 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+)
+
+// beforeSave is invoked by stateify.
+func (e *endpoint) beforeSave() {
+	// A stack.Route holds live NIC/link state that can't be serialized; a
+	// connected endpoint's route is re-resolved in afterLoad from the
+	// (already stateified) connection identity instead of being saved
+	// here directly.
+
+	// The pending cork buffer is addressed to corkRoute, which has the
+	// same problem, but there's no saved connection identity to rebuild
+	// it from afterwards: flush it now so the checkpoint never has to
+	// represent a corked route it can't reconstruct. This only affects
+	// data already buffered by MSG_MORE/UDP_CORK that hadn't been sent
+	// yet; it does not change what a restored endpoint looks like to its
+	// peer, since the alternative (dropping the buffered bytes silently)
+	// would.
+	//
+	// e.mu is deliberately not held across the flush: flushCorkLocked
+	// ends up in sendUDP/route.WritePacket, and a synchronous loopback
+	// send can trigger an ICMP response handled back on this same
+	// endpoint via HandleControlPacket, which takes e.mu itself. See
+	// sendLocked's comment for the same hazard.
+	e.corkMu.Lock()
+	if err := e.flushCorkLocked(); err != nil {
+		// The peer is unreachable from here and now; there's nothing
+		// sensible left to do with the buffered bytes other than drop
+		// them, same as a post-restore Write to an unreachable peer
+		// would.
+		e.corkBuf = buffer.VectorisedView{}
+	}
+	e.corkMu.Unlock()
+}
+
+// saveRoute is invoked by stateify.
+func (e *endpoint) saveRoute() bool {
+	return e.route != nil
+}
+
+// loadRoute is invoked by stateify.
+func (e *endpoint) loadRoute(bool) {
+	// Reconstructed in afterLoad, once e.stack is available again.
+}
+
+// saveCorkRoute is invoked by stateify.
+func (e *endpoint) saveCorkRoute() bool {
+	if e.corkRoute != nil {
+		// beforeSave always flushes and clears the cork buffer, which
+		// releases corkRoute; if this ever fires, flushing grew a new
+		// way to fail without clearing corkRoute too.
+		panic("udp: corkRoute is non-nil at save time")
+	}
+	return false
+}
+
+// loadCorkRoute is invoked by stateify.
+func (e *endpoint) loadCorkRoute(bool) {
+	// Always nil: see saveCorkRoute.
+}
+
+// afterLoad is invoked by stateify.
+func (e *endpoint) afterLoad() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.EndpointState() != StateConnected {
+		return
+	}
+
+	// Rebuild the connected peer's route the same way Connect() did
+	// originally, now that e.stack is available again.
+	addr := tcpip.FullAddress{Addr: e.ID.RemoteAddress, Port: e.dstPort}
+	r, _, err := e.connectRoute(e.RegisterNICID, addr, e.NetProto, nil)
+	if err != nil {
+		// The peer is no longer reachable from wherever we were
+		// restored to; leave e.route nil and let the next Write surface
+		// the failure, same as it would for any other route change.
+		return
+	}
+	e.route = r
+}
@@ -0,0 +1,512 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// newTestEndpoint builds a bare endpoint by hand rather than via
+// newEndpoint, on top of an empty stack.Stack with no NICs, routes or
+// protocols. The stack is there for the calls the tested code makes on it
+// (e.stack.Clock() in HandleControlPacket, e.stack.IsSubnetBroadcast() in
+// connectRoute); the rest of what the tests touch is set up here directly.
+func newTestEndpoint() *endpoint {
+	e := &endpoint{
+		stack:       stack.New(stack.Options{}),
+		waiterQueue: &waiter.Queue{},
+	}
+	e.ops.InitHandler(e)
+	e.ops.SetReceiveErr(true)
+	return e
+}
+
+// TestLiteCoverageLength checks that a UDP-Lite checksum-coverage value of
+// zero is resolved to the full datagram length, that a non-zero value no
+// larger than the datagram is passed through as-is, and that a coverage
+// larger than the datagram (e.g. a fixed UDPLITE_SEND_CSCOV held across a
+// smaller payload) is clamped down to the datagram's actual length rather
+// than producing a wire length field that overstates it. This is the
+// length that must be folded into the checksum; it is distinct from (and
+// always <=) the pseudo-header length, which per RFC 3828 is always the
+// full datagram length.
+func TestLiteCoverageLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    uint16
+		coverage uint16
+		want     int
+	}{
+		{name: "zero coverage means full datagram", total: 1500, coverage: 0, want: 1500},
+		{name: "partial coverage is passed through", total: 1500, coverage: 100, want: 100},
+		{name: "full coverage equals total", total: 64, coverage: 64, want: 64},
+		{name: "coverage larger than total is clamped to total", total: 64, coverage: 1500, want: 64},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := liteCoverageLength(test.total, test.coverage); got != test.want {
+				t.Errorf("liteCoverageLength(%d, %d) = %d, want %d", test.total, test.coverage, got, test.want)
+			}
+		})
+	}
+}
+
+// TestPMTUVerdict checks the cache-lookup/decay/clamp decisions
+// pmtuForPeer derives from a cached PMTU entry, including the boundary at
+// exactly pmtuDecayInterval and the case where the interface MTU shrank
+// below a still-fresh cached value.
+func TestPMTUVerdict(t *testing.T) {
+	const ifaceMTU = 1500
+
+	tests := []struct {
+		name        string
+		ok          bool
+		entry       pmtuEntry
+		now         int64
+		wantMTU     uint32
+		wantExpired bool
+	}{
+		{name: "no cache entry uses interface MTU", ok: false, now: 1000, wantMTU: ifaceMTU, wantExpired: false},
+		{name: "fresh entry smaller than interface MTU wins", ok: true, entry: pmtuEntry{mtu: 1280, updatedAt: 0}, now: 1000, wantMTU: 1280, wantExpired: false},
+		{name: "fresh entry larger than interface MTU is clamped", ok: true, entry: pmtuEntry{mtu: 9000, updatedAt: 0}, now: 1000, wantMTU: ifaceMTU, wantExpired: false},
+		{name: "exactly at the decay interval is not yet expired", ok: true, entry: pmtuEntry{mtu: 1280, updatedAt: 0}, now: pmtuDecayInterval, wantMTU: 1280, wantExpired: false},
+		{name: "past the decay interval expires and falls back", ok: true, entry: pmtuEntry{mtu: 1280, updatedAt: 0}, now: pmtuDecayInterval + 1, wantMTU: ifaceMTU, wantExpired: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mtu, expired := pmtuVerdict(test.ok, test.entry, test.now, ifaceMTU)
+			if mtu != test.wantMTU {
+				t.Errorf("pmtuVerdict(...) mtu = %d, want %d", mtu, test.wantMTU)
+			}
+			if expired != test.wantExpired {
+				t.Errorf("pmtuVerdict(...) expired = %v, want %v", expired, test.wantExpired)
+			}
+		})
+	}
+}
+
+// TestSameDestination checks the run-grouping predicate WriteBatch uses to
+// decide which consecutive messages share a single route resolution in
+// writeRun: same address matches, nil (the connected peer) only matches
+// nil, and differing addresses never match.
+func TestSameDestination(t *testing.T) {
+	addrA := &tcpip.FullAddress{Addr: "\x01\x02\x03\x04", Port: 53}
+	addrACopy := &tcpip.FullAddress{Addr: "\x01\x02\x03\x04", Port: 53}
+	addrB := &tcpip.FullAddress{Addr: "\x05\x06\x07\x08", Port: 53}
+
+	tests := []struct {
+		name string
+		a, b *tcpip.FullAddress
+		want bool
+	}{
+		{name: "equal addresses match", a: addrA, b: addrACopy, want: true},
+		{name: "different addresses don't match", a: addrA, b: addrB, want: false},
+		{name: "both nil (connected peer) match", a: nil, b: nil, want: true},
+		{name: "nil doesn't match an explicit address", a: nil, b: addrA, want: false},
+		{name: "an explicit address doesn't match nil", a: addrA, b: nil, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sameDestination(test.a, test.b); got != test.want {
+				t.Errorf("sameDestination(%v, %v) = %v, want %v", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
+
+// TestSamePacketInfo checks the predicate WriteBatch uses, alongside
+// sameDestination, to decide whether consecutive messages can share one
+// resolved route in a writeRun: two messages to the same peer with
+// different IP_PKTINFO overrides must not be folded into the same run.
+func TestSamePacketInfo(t *testing.T) {
+	infoA := &tcpip.IPPacketInfo{NIC: 1, LocalAddr: "\x01\x02\x03\x04"}
+	infoACopy := &tcpip.IPPacketInfo{NIC: 1, LocalAddr: "\x01\x02\x03\x04"}
+	infoB := &tcpip.IPPacketInfo{NIC: 2, LocalAddr: "\x05\x06\x07\x08"}
+
+	tests := []struct {
+		name string
+		a, b *tcpip.IPPacketInfo
+		want bool
+	}{
+		{name: "equal overrides match", a: infoA, b: infoACopy, want: true},
+		{name: "different overrides don't match", a: infoA, b: infoB, want: false},
+		{name: "both nil (no override) match", a: nil, b: nil, want: true},
+		{name: "nil doesn't match an explicit override", a: nil, b: infoA, want: false},
+		{name: "an explicit override doesn't match nil", a: infoA, b: nil, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := samePacketInfo(test.a, test.b); got != test.want {
+				t.Errorf("samePacketInfo(%v, %v) = %v, want %v", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
+
+// TestCorkMatchesPeer checks the predicate sendLocked uses to decide
+// whether a write can be folded into a pending cork buffer: dest port and
+// remote address must match, as must the source address/NIC a route
+// resolved to, so a per-write IP_PKTINFO override to an otherwise
+// identical peer correctly forces a flush instead of being silently
+// merged and sent from the wrong source/NIC.
+func TestCorkMatchesPeer(t *testing.T) {
+	const (
+		nicA  tcpip.NICID = 1
+		nicB  tcpip.NICID = 2
+		portA uint16      = 53
+		portB uint16      = 54
+	)
+	addrA := tcpip.Address("\x01\x02\x03\x04")
+	addrB := tcpip.Address("\x05\x06\x07\x08")
+
+	tests := []struct {
+		name       string
+		corkNICID  tcpip.NICID
+		nicID      tcpip.NICID
+		corkLocal  tcpip.Address
+		local      tcpip.Address
+		corkRemote tcpip.Address
+		remote     tcpip.Address
+		corkPort   uint16
+		port       uint16
+		want       bool
+	}{
+		{name: "identical peer matches", corkNICID: nicA, nicID: nicA, corkLocal: addrA, local: addrA, corkRemote: addrB, remote: addrB, corkPort: portA, port: portA, want: true},
+		{name: "different dest port doesn't match", corkNICID: nicA, nicID: nicA, corkLocal: addrA, local: addrA, corkRemote: addrB, remote: addrB, corkPort: portA, port: portB, want: false},
+		{name: "different remote address doesn't match", corkNICID: nicA, nicID: nicA, corkLocal: addrA, local: addrA, corkRemote: addrA, remote: addrB, corkPort: portA, port: portA, want: false},
+		{name: "different local address (e.g. IP_PKTINFO override) doesn't match", corkNICID: nicA, nicID: nicA, corkLocal: addrA, local: addrB, corkRemote: addrB, remote: addrB, corkPort: portA, port: portA, want: false},
+		{name: "different egress NIC (e.g. IP_PKTINFO override) doesn't match", corkNICID: nicA, nicID: nicB, corkLocal: addrA, local: addrA, corkRemote: addrB, remote: addrB, corkPort: portA, port: portA, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := corkMatchesPeer(test.corkNICID, test.nicID, test.corkLocal, test.local, test.corkRemote, test.remote, test.corkPort, test.port)
+			if got != test.want {
+				t.Errorf("corkMatchesPeer(...) = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestPktInfoLocalAddrUnspecified checks which IP_PKTINFO local-address
+// overrides connectRoute treats as "not set" (and so skips validating
+// against the egress NIC): both the empty address and the IPv4/IPv6
+// unspecified address, since a caller sending a DHCP DISCOVER from 0.0.0.0
+// out a specific NIC needs that to bypass validation, not fail it.
+func TestPktInfoLocalAddrUnspecified(t *testing.T) {
+	tests := []struct {
+		name string
+		addr tcpip.Address
+		want bool
+	}{
+		{name: "empty address is unspecified", addr: "", want: true},
+		{name: "IPv4 unspecified address is unspecified", addr: header.IPv4Any, want: true},
+		{name: "IPv6 unspecified address is unspecified", addr: header.IPv6Any, want: true},
+		{name: "a genuine IPv4 address is specified", addr: header.IPv4Loopback, want: false},
+		{name: "a genuine IPv6 address is specified", addr: header.IPv6Loopback, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := pktInfoLocalAddrUnspecified(test.addr); got != test.want {
+				t.Errorf("pktInfoLocalAddrUnspecified(%q) = %v, want %v", test.addr, got, test.want)
+			}
+		})
+	}
+}
+
+// TestControlMessagesLocked checks that controlMessagesLocked assembles the
+// ancillary control messages (TOS, TClass, packet info, original
+// destination address, TTL and timestamp) a received packet carries based on
+// which ones the endpoint's socket options ask for, including the
+// SO_TIMESTAMPING case where the unconditional legacy timestamp is
+// suppressed unless a software RX timestamp was actually requested.
+func TestControlMessagesLocked(t *testing.T) {
+	pkt := &udpPacket{
+		destinationAddress: tcpip.FullAddress{Addr: header.IPv4Loopback, Port: 53},
+		packetInfo:         tcpip.IPPacketInfo{NIC: 1, LocalAddr: header.IPv4Loopback},
+		timestamp:          1234,
+		tos:                42,
+		ttl:                64,
+	}
+
+	tests := []struct {
+		name      string
+		configure func(e *endpoint)
+		want      tcpip.ControlMessages
+	}{
+		{
+			name:      "nothing requested still gets the legacy timestamp",
+			configure: func(e *endpoint) {},
+			want:      tcpip.ControlMessages{HasTimestamp: true, Timestamp: pkt.timestamp},
+		},
+		{
+			name: "receive TOS",
+			configure: func(e *endpoint) {
+				e.ops.SetReceiveTOS(true)
+			},
+			want: tcpip.ControlMessages{HasTimestamp: true, Timestamp: pkt.timestamp, HasTOS: true, TOS: pkt.tos},
+		},
+		{
+			name: "receive TClass reuses the tos field widened to uint32",
+			configure: func(e *endpoint) {
+				e.ops.SetReceiveTClass(true)
+			},
+			want: tcpip.ControlMessages{HasTimestamp: true, Timestamp: pkt.timestamp, HasTClass: true, TClass: uint32(pkt.tos)},
+		},
+		{
+			name: "receive packet info",
+			configure: func(e *endpoint) {
+				e.ops.SetReceivePacketInfo(true)
+			},
+			want: tcpip.ControlMessages{HasTimestamp: true, Timestamp: pkt.timestamp, HasIPPacketInfo: true, PacketInfo: pkt.packetInfo},
+		},
+		{
+			name: "receive original destination address",
+			configure: func(e *endpoint) {
+				e.ops.SetReceiveOriginalDstAddress(true)
+			},
+			want: tcpip.ControlMessages{HasTimestamp: true, Timestamp: pkt.timestamp, HasOriginalDstAddress: true, OriginalDstAddress: pkt.destinationAddress},
+		},
+		{
+			name: "receive TTL",
+			configure: func(e *endpoint) {
+				e.ops.SetReceiveTTL(true)
+			},
+			want: tcpip.ControlMessages{HasTimestamp: true, Timestamp: pkt.timestamp, HasTTL: true, TTL: pkt.ttl},
+		},
+		{
+			name: "SO_TIMESTAMPING without the software RX bit suppresses the timestamp",
+			configure: func(e *endpoint) {
+				atomic.StoreInt32(&e.timestampingFlags, int32(tcpip.SOFTimestampingRxHardware))
+			},
+			want: tcpip.ControlMessages{},
+		},
+		{
+			name: "SO_TIMESTAMPING with the software RX bit reports the timestamp",
+			configure: func(e *endpoint) {
+				atomic.StoreInt32(&e.timestampingFlags, int32(tcpip.SOFTimestampingRxSoftware))
+			},
+			want: tcpip.ControlMessages{HasTimestamp: true, Timestamp: pkt.timestamp},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEndpoint()
+			test.configure(e)
+			if got := e.controlMessagesLocked(pkt); got != test.want {
+				t.Errorf("controlMessagesLocked() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestConnectRouteRejectsConflictingPacketInfoNIC checks that connectRoute
+// rejects an IP_PKTINFO-requested egress NIC that conflicts with the
+// endpoint's bound device, the same way resolveExplicitRouteLocked already
+// rejects a conflicting explicit destination NIC. Without this check, a
+// per-write cmsg could be used to send out a NIC the endpoint was never
+// bound to, bypassing the bind-to-device restriction entirely.
+func TestConnectRouteRejectsConflictingPacketInfoNIC(t *testing.T) {
+	const boundNIC tcpip.NICID = 5
+	const otherNIC tcpip.NICID = 99
+
+	e := newTestEndpoint()
+	e.BindNICID = boundNIC
+
+	addr := tcpip.FullAddress{Addr: header.IPv4Loopback, Port: 53}
+	pktInfo := &tcpip.IPPacketInfo{NIC: otherNIC}
+	if _, _, err := e.connectRoute(boundNIC, addr, header.IPv4ProtocolNumber, pktInfo); err != tcpip.ErrNoRoute {
+		t.Errorf("connectRoute() with conflicting PacketInfo.NIC = %v, want %v", err, tcpip.ErrNoRoute)
+	}
+}
+
+// TestReadErrQueuePortUnreachable checks that a ControlPortUnreachable
+// control packet (what the network layer reports after a loopback ICMP
+// Destination/Port Unreachable) is queued and observable via ReadErrQueue,
+// and that ReadErrQueue reports ErrWouldBlock once drained. This exercises
+// HandleControlPacket/queueErr/ReadErrQueue directly rather than via an
+// actual loopback send/ICMP-reply round trip, since newTestEndpoint's stack
+// has no NICs to send through.
+func TestReadErrQueuePortUnreachable(t *testing.T) {
+	e := newTestEndpoint()
+
+	const remotePort = 53
+	id := stack.TransportEndpointID{
+		LocalPort:     12345,
+		LocalAddress:  header.IPv4Loopback,
+		RemotePort:    remotePort,
+		RemoteAddress: header.IPv4Loopback,
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.View("probe").ToVectorisedView(),
+	})
+	pkt.NICID = 1
+
+	e.HandleControlPacket(id, stack.ControlPortUnreachable, 0, pkt)
+
+	payload, cmsg, err := e.ReadErrQueue()
+	if err != nil {
+		t.Fatalf("ReadErrQueue() after PortUnreachable: got err %v, want nil", err)
+	}
+	if got, want := string(payload), "probe"; got != want {
+		t.Errorf("ReadErrQueue() payload = %q, want %q", got, want)
+	}
+	if cmsg.Type != stack.ControlPortUnreachable {
+		t.Errorf("ReadErrQueue() cmsg.Type = %v, want %v", cmsg.Type, stack.ControlPortUnreachable)
+	}
+	if cmsg.Dst.Addr != header.IPv4Loopback || cmsg.Dst.Port != remotePort {
+		t.Errorf("ReadErrQueue() cmsg.Dst = %+v, want Addr=%v Port=%d", cmsg.Dst, header.IPv4Loopback, remotePort)
+	}
+
+	if _, _, err := e.ReadErrQueue(); err != tcpip.ErrWouldBlock {
+		t.Errorf("ReadErrQueue() on drained queue: got err %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+// TestClassicBPFVerdict checks the drop/truncate/accept decisions
+// runFilterAndTrim derives from a classic-BPF program's return value,
+// including the two edge cases Linux's SO_ATTACH_FILTER also has to handle:
+// the 0xFFFFFFFF accept-everything sentinel, and a truncation length that
+// would otherwise cut into the already-consumed L3/UDP headers.
+func TestClassicBPFVerdict(t *testing.T) {
+	const full = 100
+	const hdrLen = 28
+
+	tests := []struct {
+		name         string
+		n            int
+		err          error
+		wantKeep     bool
+		wantTruncate int
+	}{
+		{name: "eval error drops", n: 0, err: errors.New("bpf: eval error"), wantKeep: false},
+		{name: "zero return drops", n: 0, err: nil, wantKeep: false},
+		{name: "truncate to a length within the payload", n: 40, wantKeep: true, wantTruncate: 40},
+		{name: "truncation clamped up to hdrLen", n: 10, wantKeep: true, wantTruncate: hdrLen},
+		{name: "n == full keeps the packet whole", n: full, wantKeep: true, wantTruncate: full},
+		{name: "classic 0xFFFFFFFF sentinel accepts unmodified", n: 0xFFFFFFFF, wantKeep: true, wantTruncate: full},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keep, truncateTo := classicBPFVerdict(test.n, test.err, full, hdrLen)
+			if keep != test.wantKeep {
+				t.Errorf("classicBPFVerdict(%d, %v, %d, %d) keep = %v, want %v", test.n, test.err, full, hdrLen, keep, test.wantKeep)
+			}
+			if keep && truncateTo != test.wantTruncate {
+				t.Errorf("classicBPFVerdict(%d, %v, %d, %d) truncateTo = %d, want %d", test.n, test.err, full, hdrLen, truncateTo, test.wantTruncate)
+			}
+		})
+	}
+}
+
+// TestSetSocketFilterAtomicSwap exercises SetSocketFilter's atomic pointer
+// swap concurrently with the atomic.LoadPointer read runFilterAndTrim's
+// caller does, under the race detector: a non-atomic swap would be flagged
+// as a data race here. It only exercises the detach (empty prog) fast path
+// of SetSocketFilter; compiling an actual classic-BPF program to race an
+// attach against a detach would need pkg/bpf, which isn't part of this
+// trimmed source tree.
+func TestSetSocketFilterAtomicSwap(t *testing.T) {
+	e := newTestEndpoint()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if err := e.SetSocketFilter(nil); err != nil {
+				t.Errorf("SetSocketFilter(nil) = %v, want nil", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_ = atomic.LoadPointer(&e.filter)
+		}
+	}()
+	wg.Wait()
+}
+
+// BenchmarkPacketDelivery compares HandlePacket's per-packet rcvMu
+// acquisition and EventIn notification against a single acquisition and
+// notification shared across a burst, for already-prepared packets of the
+// same burst size. It isolates the locking pattern each delivery style
+// costs; it does not call HandlePacket directly, since that starts by
+// calling preparePacket, which needs packets with real network and UDP
+// headers and would add its parsing and checksum work to the timings.
+func BenchmarkPacketDelivery(b *testing.B) {
+	const burst = 32
+
+	for _, batched := range []bool{false, true} {
+		name := "PerPacketLock"
+		if batched {
+			name = "BatchedLock"
+		}
+		b.Run(name, func(b *testing.B) {
+			e := newTestEndpoint()
+			e.rcvReady = true
+			e.rcvBufSizeMax = 1 << 30
+
+			packets := make([]*udpPacket, burst)
+			for i := range packets {
+				packets[i] = &udpPacket{}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if batched {
+					e.rcvMu.Lock()
+					wasEmpty := e.rcvBufSize == 0
+					accepted := false
+					for _, p := range packets {
+						if !e.enqueuePacketLocked(p) {
+							break
+						}
+						accepted = true
+					}
+					e.rcvMu.Unlock()
+					if accepted && wasEmpty {
+						e.waiterQueue.Notify(waiter.EventIn)
+					}
+				} else {
+					for _, p := range packets {
+						e.rcvMu.Lock()
+						wasEmpty := e.rcvBufSize == 0
+						accepted := e.enqueuePacketLocked(p)
+						e.rcvMu.Unlock()
+						if accepted && wasEmpty {
+							e.waiterQueue.Notify(waiter.EventIn)
+						}
+					}
+				}
+
+				e.rcvMu.Lock()
+				e.rcvList = udpPacketList{}
+				e.rcvBufSize = 0
+				e.rcvMu.Unlock()
+			}
+		})
+	}
+}
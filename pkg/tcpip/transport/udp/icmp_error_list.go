@@ -0,0 +1,70 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+// icmpErrorList is an intrusive doubly-linked list of *icmpError,
+// following the same generated-list shape as udpPacketList (see
+// ilist_generic.go in this repo for the template this mirrors). The list
+// itself has no size limit; queueErr keeps it at most maxErrQueueSize long.
+type icmpErrorList struct {
+	head *icmpError
+	tail *icmpError
+}
+
+// icmpErrorEntry is embedded in icmpError to make it a member of
+// icmpErrorList.
+type icmpErrorEntry struct {
+	next *icmpError
+	prev *icmpError
+}
+
+// Empty returns true iff the list is empty.
+func (l *icmpErrorList) Empty() bool {
+	return l.head == nil
+}
+
+// Front returns the first element of list l or nil.
+func (l *icmpErrorList) Front() *icmpError {
+	return l.head
+}
+
+// PushBack inserts e at the back of list l.
+func (l *icmpErrorList) PushBack(e *icmpError) {
+	e.next = nil
+	e.prev = l.tail
+
+	if l.tail != nil {
+		l.tail.next = e
+	} else {
+		l.head = e
+	}
+	l.tail = e
+}
+
+// Remove removes e from list l.
+func (l *icmpErrorList) Remove(e *icmpError) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		l.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		l.tail = e.prev
+	}
+	e.next = nil
+	e.prev = nil
+}
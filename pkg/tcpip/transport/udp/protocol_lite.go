@@ -0,0 +1,120 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// UDPLiteProtocolName is the string transport protocol name for UDP-Lite,
+// used to register and look up the protocol factory (e.g. from a network
+// stack's transport protocol option by name).
+const UDPLiteProtocolName = "udplite"
+
+// UDPLiteProtocolNumber is the transport protocol number for UDP-Lite
+// (RFC 3828). UDP-Lite is otherwise wire-compatible with UDP: it reuses the
+// same header layout, but reinterprets the length field as a
+// checksum-coverage length and always requires a checksum.
+const UDPLiteProtocolNumber tcpip.TransportProtocolNumber = 136
+
+// NewLiteEndpoint creates a UDP-Lite endpoint. It is the UDP-Lite analogue
+// of NewEndpoint, sharing the same endpoint implementation but registering
+// under UDPLiteProtocolNumber so the length field is reinterpreted as
+// checksum coverage everywhere that matters (send, receive, registration).
+func NewLiteEndpoint(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) tcpip.Endpoint {
+	e := newEndpoint(s, netProto, waiterQueue)
+	e.TransProto = UDPLiteProtocolNumber
+	return e
+}
+
+// liteProtocol implements stack.TransportProtocol for UDP-Lite, making
+// NewLiteEndpoint reachable from socket(2) the same way the plain UDP
+// protocol type (not present in this package) would make NewEndpoint
+// reachable: by registering a factory the stack's protocol dispatch can
+// look up by number.
+type liteProtocol struct{}
+
+// Number implements stack.TransportProtocol.Number.
+func (*liteProtocol) Number() tcpip.TransportProtocolNumber {
+	return UDPLiteProtocolNumber
+}
+
+// NewEndpoint implements stack.TransportProtocol.NewEndpoint.
+func (*liteProtocol) NewEndpoint(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	return NewLiteEndpoint(s, netProto, waiterQueue), nil
+}
+
+// NewRawEndpoint implements stack.TransportProtocol.NewRawEndpoint.
+func (*liteProtocol) NewRawEndpoint(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	return nil, tcpip.ErrNotSupported
+}
+
+// MinimumPacketSize implements stack.TransportProtocol.MinimumPacketSize.
+func (*liteProtocol) MinimumPacketSize() int {
+	return header.UDPMinimumSize
+}
+
+// ParsePorts implements stack.TransportProtocol.ParsePorts.
+func (*liteProtocol) ParsePorts(v buffer.View) (src, dst uint16, err *tcpip.Error) {
+	if len(v) < header.UDPMinimumSize {
+		return 0, 0, tcpip.ErrBadAddress
+	}
+	h := header.UDP(v)
+	return h.SourcePort(), h.DestinationPort(), nil
+}
+
+// HandleUnknownDestinationPacket implements
+// stack.TransportProtocol.HandleUnknownDestinationPacket. Like plain UDP,
+// there's no connection state to reset and no payload worth echoing back,
+// so an unmatched datagram is just dropped.
+func (*liteProtocol) HandleUnknownDestinationPacket(id *stack.TransportEndpointID, pkt *stack.PacketBuffer) stack.UnknownDestinationPacketDisposition {
+	return stack.UnknownDestinationPacketHandled
+}
+
+// SetOption implements stack.TransportProtocol.SetOption. UDP-Lite has no
+// protocol-level options of its own.
+func (*liteProtocol) SetOption(option tcpip.SettableTransportProtocolOption) *tcpip.Error {
+	return tcpip.ErrUnknownProtocolOption
+}
+
+// Option implements stack.TransportProtocol.Option.
+func (*liteProtocol) Option(option tcpip.GettableTransportProtocolOption) *tcpip.Error {
+	return tcpip.ErrUnknownProtocolOption
+}
+
+// Close implements stack.TransportProtocol.Close.
+func (*liteProtocol) Close() {}
+
+// Wait implements stack.TransportProtocol.Wait.
+func (*liteProtocol) Wait() {}
+
+// Parse implements stack.TransportProtocol.Parse, splitting the fixed-size
+// UDP-Lite header (wire-compatible with plain UDP's) off of pkt's data into
+// pkt's transport header, the same split HandlePacket/preparePacket assume
+// has already happened by the time a packet reaches this package.
+func (*liteProtocol) Parse(pkt *stack.PacketBuffer) bool {
+	_, ok := pkt.TransportHeader().Consume(header.UDPMinimumSize)
+	return ok
+}
+
+func init() {
+	stack.RegisterTransportProtocolFactory(UDPLiteProtocolName, func() stack.TransportProtocol {
+		return &liteProtocol{}
+	})
+}